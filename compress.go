@@ -1,11 +1,19 @@
 package gear
 
 import (
+	"bufio"
 	"compress/flate"
 	"compress/gzip"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 // Compressible interface is use to enable compress response context.
@@ -38,35 +46,472 @@ type DefaultCompress struct{}
 //  app.Error(app.Listen(":3000")) // http://127.0.0.1:3000/
 //
 func (d *DefaultCompress) Compressible(contentType string, contentLength int) bool {
-	if contentLength > 0 && contentLength <= 1024 {
+	return defaultCompress.Compressible(contentType, contentLength)
+}
+
+// defaultCompress is the shared instance DefaultCompress delegates to, so
+// the two stay in sync.
+var defaultCompress = NewDefaultCompress(nil)
+
+// defaultCompressibleTypes is the well-known set of MIME types worth
+// compressing, matching what chi's and gorilla's compress middleware ship.
+var defaultCompressibleTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/javascript",
+	"text/xml",
+	"text/markdown",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/atom+xml",
+	"application/rss+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// DefaultCompressOptions configures NewDefaultCompress.
+type DefaultCompressOptions struct {
+	// Threshold is the minimum Content-Length, in bytes, a response needs
+	// before it's worth compressing. Defaults to 1024.
+	Threshold int
+	// Types is the set of compressible Content-Types. An entry may use a
+	// wildcard subtype, e.g. "text/*". Defaults to defaultCompressibleTypes.
+	Types []string
+}
+
+// compressibleSet is a normalized, queryable form of
+// DefaultCompressOptions.Types.
+type compressibleSet struct {
+	exact     map[string]bool
+	wildcards map[string]bool // top-level type, e.g. "text" for "text/*"
+}
+
+func newCompressibleSet(types []string) *compressibleSet {
+	set := &compressibleSet{exact: map[string]bool{}, wildcards: map[string]bool{}}
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if strings.HasSuffix(t, "/*") {
+			set.wildcards[strings.TrimSuffix(t, "/*")] = true
+			continue
+		}
+		set.exact[t] = true
+	}
+	return set
+}
+
+func (set *compressibleSet) has(contentType string) bool {
+	contentType = normalizeContentType(contentType)
+	if contentType == "" {
+		return false
+	}
+	if set.exact[contentType] {
+		return true
+	}
+	if i := strings.IndexByte(contentType, '/'); i >= 0 {
+		return set.wildcards[contentType[:i]]
+	}
+	return false
+}
+
+// normalizeContentType strips parameters (e.g. `; charset=utf-8`) and
+// lower-cases a Content-Type header value for matching.
+func normalizeContentType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// compressByTypeAndSize implements Compressible against an allow-list of
+// MIME types and a minimum size threshold. Build one with NewDefaultCompress.
+type compressByTypeAndSize struct {
+	threshold int
+	types     *compressibleSet
+}
+
+// NewDefaultCompress builds a Compressible that only compresses responses
+// whose Content-Type is in opts.Types (or defaultCompressibleTypes, if nil
+// or empty) and whose Content-Length is over opts.Threshold (or 1024, if
+// not positive). A Content-Length of 0, meaning the length isn't known yet,
+// passes the size check:
+//
+//  app.Set("AppCompress", gear.NewDefaultCompress(&gear.DefaultCompressOptions{
+//  	Threshold: 256,
+//  	Types:     []string{"text/*", "application/json"},
+//  }))
+//
+func NewDefaultCompress(opts *DefaultCompressOptions) Compressible {
+	threshold := 1024
+	types := defaultCompressibleTypes
+	if opts != nil {
+		if opts.Threshold > 0 {
+			threshold = opts.Threshold
+		}
+		if len(opts.Types) > 0 {
+			types = opts.Types
+		}
+	}
+	return &compressByTypeAndSize{threshold: threshold, types: newCompressibleSet(types)}
+}
+
+// Compressible implemented Compress interface.
+func (c *compressByTypeAndSize) Compressible(contentType string, contentLength int) bool {
+	if contentLength > 0 && contentLength <= c.threshold {
 		return false
 	}
-	return contentType != ""
+	return c.types.has(contentType)
+}
+
+// noLevel marks a CompressOptions.Levels entry as "not configured", so that
+// the chosen encoder falls back to its registered default level.
+const noLevel = -2
+
+// defaultEncodings is the server-side precedence gear uses to break ties
+// when a client's Accept-Encoding offers more than one acceptable encoding.
+var defaultEncodings = []string{"zstd", "br", "gzip", "deflate"}
+
+// CompressOptions configures how gear negotiates response content encodings.
+// Pass it, instead of a bare Compressible, to app.Set("AppCompress", ...) to
+// control which encodings are offered to clients, their compression level,
+// and the server-side precedence used when a client accepts more than one:
+//
+//  app.Set("AppCompress", &gear.CompressOptions{
+//  	Compressible: &gear.DefaultCompress{},
+//  	Encodings:    []string{"zstd", "br", "gzip"},
+//  	Levels:       map[string]int{"gzip": gzip.BestSpeed},
+//  })
+//
+// A CompressOptions must not be copied after first use: it lazily owns the
+// Compressor pool backing its encoders.
+type CompressOptions struct {
+	// Compressible decides whether a given response should be compressed at
+	// all. Defaults to &DefaultCompress{} when nil.
+	Compressible
+	// Encodings lists the encodings gear may use to compress a response, in
+	// order of server-side precedence. Defaults to
+	// []string{"zstd", "br", "gzip", "deflate"}.
+	Encodings []string
+	// Levels maps an encoding name to its compression level, on that
+	// encoding's own conventional scale (gzip/deflate: 1-9, brotli: 0-11,
+	// zstd: 1-22, per zstd.EncoderLevelFromZstd). An encoding without an
+	// entry here uses that encoding's registered default level.
+	Levels map[string]int
+
+	once       sync.Once
+	compressor *Compressor
+}
+
+func (co *CompressOptions) compressible() Compressible {
+	if co == nil || co.Compressible == nil {
+		return &DefaultCompress{}
+	}
+	return co.Compressible
+}
+
+func (co *CompressOptions) encodings() []string {
+	if co == nil || len(co.Encodings) == 0 {
+		return defaultEncodings
+	}
+	return co.Encodings
+}
+
+func (co *CompressOptions) level(encoding string) int {
+	if co == nil {
+		return noLevel
+	}
+	if l, ok := co.Levels[encoding]; ok {
+		return l
+	}
+	return noLevel
+}
+
+// defaultCompressor backs compressWriters created with a nil CompressOptions.
+var defaultCompressor = &Compressor{}
+
+func (co *CompressOptions) pool() *Compressor {
+	if co == nil {
+		return defaultCompressor
+	}
+	co.once.Do(func() {
+		co.compressor = &Compressor{}
+	})
+	return co.compressor
+}
+
+// acceptedEncoding is one token of a parsed Accept-Encoding header, together
+// with its q-value weight.
+type acceptedEncoding struct {
+	name string
+	q    float64
+}
+
+// parseAcceptEncoding parses a raw Accept-Encoding header value into its
+// tokens and q-values, per RFC 7231 §5.3.4.
+func parseAcceptEncoding(acceptEncoding string) []acceptedEncoding {
+	if acceptEncoding == "" {
+		return nil
+	}
+
+	tokens := strings.Split(acceptEncoding, ",")
+	accepted := make([]acceptedEncoding, 0, len(tokens))
+	for _, token := range tokens {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		name, q := token, 1.0
+		if i := strings.IndexByte(token, ';'); i >= 0 {
+			name = strings.TrimSpace(token[:i])
+			if qv, ok := parseQValue(token[i+1:]); ok {
+				q = qv
+			}
+		}
+		accepted = append(accepted, acceptedEncoding{name: strings.ToLower(name), q: q})
+	}
+	return accepted
+}
+
+// parseQValue extracts the `q` weight from an Accept-Encoding parameter
+// segment such as `q=0.5`.
+func parseQValue(param string) (float64, bool) {
+	param = strings.TrimSpace(param)
+	if !strings.HasPrefix(strings.ToLower(param), "q=") {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(strings.TrimSpace(param[2:]), 64)
+	if err != nil {
+		return 0, false
+	}
+	return q, true
+}
+
+// negotiateEncoding picks the best encoding for acceptEncoding out of the
+// server's precedence-ordered, supported encodings, honoring q-values and
+// the `*` wildcard. ok is false only when the client's Accept-Encoding
+// explicitly rules out every supported encoding as well as identity (e.g.
+// `identity;q=0`) — callers should respond 406 Not Acceptable in that case,
+// per RFC 7231 §5.3.4. An empty encoding with ok == true means "send the
+// response uncompressed".
+func negotiateEncoding(acceptEncoding string, supported []string) (encoding string, ok bool) {
+	accepted := parseAcceptEncoding(acceptEncoding)
+	if len(accepted) == 0 {
+		return "", true
+	}
+
+	weight := func(name string) (q float64, found bool) {
+		wildcard, hasWildcard := -1.0, false
+		for _, a := range accepted {
+			if a.name == name {
+				return a.q, true
+			}
+			if a.name == "*" {
+				wildcard, hasWildcard = a.q, true
+			}
+		}
+		return wildcard, hasWildcard
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range supported {
+		if q, found := weight(enc); found && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	if best != "" {
+		return best, true
+	}
+
+	if q, found := weight("identity"); found && q == 0 {
+		return "", false
+	}
+	return "", true
+}
+
+// encoderFactory builds a new encoder of a registered encoding, writing to w
+// at the given level.
+type encoderFactory func(w io.Writer, level int) (io.WriteCloser, error)
+
+// resetWriteCloser is implemented by encoders that can be rebound to a new
+// underlying writer after Close, which is what lets Compressor return them
+// to their pool instead of discarding them.
+type resetWriteCloser interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+type encoderEntry struct {
+	level   int
+	factory encoderFactory
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]encoderEntry{
+		"gzip": {
+			level: gzip.DefaultCompression,
+			factory: func(w io.Writer, level int) (io.WriteCloser, error) {
+				return gzip.NewWriterLevel(w, level)
+			},
+		},
+		"deflate": {
+			level: flate.DefaultCompression,
+			factory: func(w io.Writer, level int) (io.WriteCloser, error) {
+				return flate.NewWriter(w, level)
+			},
+		},
+		"br": {
+			level: int(brotli.DefaultCompression),
+			factory: func(w io.Writer, level int) (io.WriteCloser, error) {
+				return brotli.NewWriterLevel(w, level), nil
+			},
+		},
+		"zstd": {
+			// 3 is zstd's own conventional default level, which
+			// zstd.EncoderLevelFromZstd maps to zstd.SpeedDefault.
+			level: 3,
+			factory: func(w io.Writer, level int) (io.WriteCloser, error) {
+				zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+				if err != nil {
+					return nil, err
+				}
+				return &zstdEncoder{zw}, nil
+			},
+		},
+	}
+)
+
+// zstdEncoder is *zstd.Encoder under gear's own name; its Write, Close, and
+// Reset(w io.Writer) already satisfy resetWriteCloser as embedded.
+type zstdEncoder struct {
+	*zstd.Encoder
+}
+
+// RegisterEncoder adds or replaces the encoder gear uses for name, along
+// with the level applied when a CompressOptions doesn't configure one for
+// that encoding. This lets callers plug in third-party encoders — e.g.
+// klauspost/compress's gzip, or a brotli build tuned for their workload —
+// without changing gear itself. factory should report an error rather than
+// returning a nil or otherwise unusable io.WriteCloser, so a bad level (or
+// any other construction failure) falls back to an uncompressed response
+// instead of panicking on first Write.
+func RegisterEncoder(name string, level int, factory func(w io.Writer, level int) (io.WriteCloser, error)) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[name] = encoderEntry{level: level, factory: factory}
+}
+
+func lookupEncoder(name string) (encoderEntry, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	e, ok := encoders[name]
+	return e, ok
+}
+
+// compressorKey identifies one sync.Pool of encoders: a given encoding at a
+// given compression level.
+type compressorKey struct {
+	encoding string
+	level    int
+}
+
+// Compressor pools per-(encoding, level) compression writers so repeated
+// requests reuse encoder state instead of allocating a fresh one each time —
+// a gzip writer alone holds onto around 800KB. The zero value is ready to
+// use; a *CompressOptions owns one for the lifetime of the app.
+type Compressor struct {
+	pools sync.Map // compressorKey -> *sync.Pool
+}
+
+// Get returns a writer for encoding at level (noLevel uses the encoding's
+// registered default) that writes to w. Close the returned writer when
+// done: if its encoder supports Reset, Compressor returns it to the pool
+// instead of discarding it.
+func (c *Compressor) Get(encoding string, level int, w io.Writer) (io.WriteCloser, error) {
+	entry, ok := lookupEncoder(encoding)
+	if !ok {
+		return nil, fmt.Errorf("gear: no encoder registered for encoding %q", encoding)
+	}
+	if level == noLevel {
+		level = entry.level
+	}
+
+	pool := c.poolFor(encoding, level)
+	if cached := pool.Get(); cached != nil {
+		enc := cached.(resetWriteCloser)
+		enc.Reset(w)
+		return &pooledWriteCloser{WriteCloser: enc, pool: pool}, nil
+	}
+
+	enc, err := entry.factory(w, level)
+	if err != nil {
+		return nil, fmt.Errorf("gear: building %q encoder: %w", encoding, err)
+	}
+	if rwc, ok := enc.(resetWriteCloser); ok {
+		return &pooledWriteCloser{WriteCloser: rwc, pool: pool}, nil
+	}
+	// The encoder can't be Reset onto a new writer, so there's nothing to
+	// pool; hand it back as a plain, one-shot WriteCloser.
+	return enc, nil
+}
+
+func (c *Compressor) poolFor(encoding string, level int) *sync.Pool {
+	key := compressorKey{encoding, level}
+	if p, ok := c.pools.Load(key); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := c.pools.LoadOrStore(key, &sync.Pool{})
+	return p.(*sync.Pool)
+}
+
+// pooledWriteCloser returns its encoder to its pool on Close instead of
+// letting it be garbage collected.
+type pooledWriteCloser struct {
+	io.WriteCloser
+	pool *sync.Pool
+}
+
+func (pw *pooledWriteCloser) Close() error {
+	err := pw.WriteCloser.Close()
+	pw.pool.Put(pw.WriteCloser)
+	return err
 }
 
 // http.ResponseWriter wrapper
 type compressWriter struct {
 	compress   Compressible
 	encoding   string
+	level      int
+	pool       *Compressor
 	writer     io.WriteCloser
 	rw         http.ResponseWriter
 	bodyLength *int
 }
 
-func newCompress(res *Response, c Compressible, acceptEncoding string) *compressWriter {
-	encodings := strings.Split(acceptEncoding, ",")
-	encoding := strings.TrimSpace(encodings[0])
-	switch encoding {
-	case "gzip", "deflate":
-		return &compressWriter{
-			compress:   c,
-			rw:         res.rw,
-			encoding:   encoding,
-			bodyLength: &res.bodyLength,
-		}
-	default:
-		return nil
+// newCompress negotiates an encoding for acceptEncoding against opts and
+// returns a compressWriter for it. notAcceptable is true when the request
+// must be rejected with 406 Not Acceptable instead; cw is nil whenever no
+// compression should be applied, whether because nothing was negotiated or
+// because the request is not acceptable.
+func newCompress(res *Response, opts *CompressOptions, acceptEncoding string) (cw *compressWriter, notAcceptable bool) {
+	encoding, ok := negotiateEncoding(acceptEncoding, opts.encodings())
+	if !ok {
+		return nil, true
 	}
+	if encoding == "" {
+		return nil, false
+	}
+
+	return &compressWriter{
+		compress:   opts.compressible(),
+		rw:         res.rw,
+		encoding:   encoding,
+		level:      opts.level(encoding),
+		pool:       opts.pool(),
+		bodyLength: &res.bodyLength,
+	}, false
 }
 
 func (cw *compressWriter) WriteHeader(code int) {
@@ -78,17 +523,11 @@ func (cw *compressWriter) WriteHeader(code int) {
 	}
 
 	header := cw.Header()
+	if !cw.compressible(code, header) {
+		return
+	}
 	if cw.compress.Compressible(header.Get(HeaderContentType), *cw.bodyLength) {
-		var w io.WriteCloser
-
-		switch cw.encoding {
-		case "gzip":
-			w, _ = gzip.NewWriterLevel(cw.rw, gzip.DefaultCompression)
-		case "deflate":
-			w, _ = flate.NewWriter(cw.rw, flate.DefaultCompression)
-		}
-
-		if w != nil {
+		if w, err := cw.pool.Get(cw.encoding, cw.level, cw.rw); err == nil {
 			cw.writer = w
 			header.Set(HeaderVary, HeaderAcceptEncoding)
 			header.Set(HeaderContentEncoding, cw.encoding)
@@ -97,6 +536,34 @@ func (cw *compressWriter) WriteHeader(code int) {
 	}
 }
 
+// compressible reports whether this response is even eligible for
+// compression, independent of cw.compress's content-type/size heuristics.
+// It guards the cases compressing would make incorrect: a response the
+// handler already encoded itself (HeaderContentEncoding already set), a
+// byte-range response (206 Partial Content or a Content-Range header,
+// whose offsets compression would invalidate), and a response marked
+// Cache-Control: no-transform, which RFC 7234 §5.2.2.6 forbids altering.
+func (cw *compressWriter) compressible(code int, header http.Header) bool {
+	if header.Get(HeaderContentEncoding) != "" {
+		return false
+	}
+	if code == http.StatusPartialContent || header.Get(HeaderContentRange) != "" {
+		return false
+	}
+	return !hasNoTransform(header.Get(HeaderCacheControl))
+}
+
+// hasNoTransform reports whether a Cache-Control header value contains the
+// no-transform directive.
+func hasNoTransform(cacheControl string) bool {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+			return true
+		}
+	}
+	return false
+}
+
 func (cw *compressWriter) Header() http.Header {
 	return cw.rw.Header()
 }
@@ -114,3 +581,76 @@ func (cw *compressWriter) Close() error {
 	}
 	return nil
 }
+
+// flusher is implemented by every encoder gear uses: Flush emits a sync
+// marker without closing the stream, so buffered data already written
+// reaches the client.
+type flusher interface {
+	Flush() error
+}
+
+// Flush implements http.Flusher. It flushes the active encoder, if any, so
+// data already written reaches the client, then flushes the underlying
+// ResponseWriter — this is what lets streaming responses such as
+// Server-Sent Events work with AppCompress enabled.
+func (cw *compressWriter) Flush() {
+	w := cw.writer
+	if pw, ok := w.(*pooledWriteCloser); ok {
+		w = pw.WriteCloser
+	}
+	if f, ok := w.(flusher); ok {
+		_ = f.Flush()
+	}
+	if f, ok := cw.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker by bypassing compression entirely and
+// returning the raw connection, so WebSocket and other protocol upgrades
+// keep working with AppCompress enabled.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("gear: underlying ResponseWriter does not support http.Hijacker")
+	}
+	return hj.Hijack()
+}
+
+// CloseNotify implements the deprecated http.CloseNotifier, forwarding to
+// the underlying ResponseWriter when it supports it.
+func (cw *compressWriter) CloseNotify() <-chan bool {
+	if cn, ok := cw.rw.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// Push implements http.Pusher, forwarding to the underlying ResponseWriter
+// when it supports HTTP/2 server push.
+func (cw *compressWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := cw.rw.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+// writerOnly hides any io.ReaderFrom a compressWriter implements, so
+// io.Copy's readFrom fast path can't recurse back into ReadFrom below.
+type writerOnly struct {
+	io.Writer
+}
+
+// ReadFrom implements io.ReaderFrom. With no encoder active it forwards to
+// the underlying ResponseWriter's io.ReaderFrom, preserving zero-copy
+// sendfile for things like static assets; once an encoder is active, data
+// must pass through it, so this falls back to io.Copy's normal Write path.
+func (cw *compressWriter) ReadFrom(r io.Reader) (int64, error) {
+	if cw.writer == nil {
+		if rf, ok := cw.rw.(io.ReaderFrom); ok {
+			return rf.ReadFrom(r)
+		}
+	}
+	return io.Copy(writerOnly{cw}, r)
+}
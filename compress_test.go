@@ -0,0 +1,278 @@
+package gear
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []acceptedEncoding
+	}{
+		{"", nil},
+		{"gzip", []acceptedEncoding{{"gzip", 1}}},
+		{"gzip, deflate", []acceptedEncoding{{"gzip", 1}, {"deflate", 1}}},
+		{"gzip;q=0.5, br;q=1.0", []acceptedEncoding{{"gzip", 0.5}, {"br", 1}}},
+		{"*;q=0", []acceptedEncoding{{"*", 0}}},
+		{"gzip;q=bogus", []acceptedEncoding{{"gzip", 1}}},
+	}
+	for _, tt := range tests {
+		got := parseAcceptEncoding(tt.header)
+		if len(got) != len(tt.want) {
+			t.Errorf("parseAcceptEncoding(%q) = %v, want %v", tt.header, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseAcceptEncoding(%q)[%d] = %v, want %v", tt.header, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	supported := []string{"zstd", "br", "gzip", "deflate"}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantEncoding   string
+		wantOK         bool
+	}{
+		{"no header means identity", "", "", true},
+		{"single encoding", "gzip", "gzip", true},
+		{"precedence breaks ties", "gzip, br, zstd", "zstd", true},
+		{"q-values are honored", "zstd;q=0, br;q=1, gzip;q=1", "br", true},
+		{"wildcard matches unsupported-by-name", "*", "zstd", true},
+		{"wildcard q=0 also rules out identity", "gzip;q=0, *;q=0", "", false},
+		{"identity;q=0 with nothing else acceptable is 406", "identity;q=0", "", false},
+		{"identity;q=0 but an encoding is acceptable", "identity;q=0, gzip", "gzip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoding, ok := negotiateEncoding(tt.acceptEncoding, supported)
+			if encoding != tt.wantEncoding || ok != tt.wantOK {
+				t.Errorf("negotiateEncoding(%q) = (%q, %v), want (%q, %v)",
+					tt.acceptEncoding, encoding, ok, tt.wantEncoding, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCompressByTypeAndSize(t *testing.T) {
+	c := NewDefaultCompress(&DefaultCompressOptions{
+		Threshold: 256,
+		Types:     []string{"text/*", "application/json"},
+	})
+
+	tests := []struct {
+		contentType   string
+		contentLength int
+		want          bool
+	}{
+		{"text/html; charset=utf-8", 1024, true},
+		{"application/json", 1024, true},
+		{"application/xml", 1024, false},
+		{"text/html", 100, false},
+		{"text/html", 0, true}, // unknown length (streaming) isn't rejected on size
+		{"", 1024, false},
+	}
+	for _, tt := range tests {
+		got := c.Compressible(tt.contentType, tt.contentLength)
+		if got != tt.want {
+			t.Errorf("Compressible(%q, %d) = %v, want %v", tt.contentType, tt.contentLength, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultCompressDelegatesToNewDefaultCompress(t *testing.T) {
+	old := &DefaultCompress{}
+	fresh := NewDefaultCompress(nil)
+
+	tests := []struct {
+		contentType   string
+		contentLength int
+	}{
+		{"text/html", 2048},
+		{"application/xml", 2048},
+		{"text/html", 100},
+	}
+	for _, tt := range tests {
+		if got, want := old.Compressible(tt.contentType, tt.contentLength), fresh.Compressible(tt.contentType, tt.contentLength); got != want {
+			t.Errorf("DefaultCompress.Compressible(%q, %d) = %v, want %v (NewDefaultCompress(nil))",
+				tt.contentType, tt.contentLength, got, want)
+		}
+	}
+}
+
+func TestCompressorPoolsEncoders(t *testing.T) {
+	pool := &Compressor{}
+	var buf1, buf2 bytes.Buffer
+
+	w1, err := pool.Get("gzip", noLevel, &buf1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, err := w1.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w1.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	first := w1.(*pooledWriteCloser).WriteCloser
+
+	w2, err := pool.Get("gzip", noLevel, &buf2)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if second := w2.(*pooledWriteCloser).WriteCloser; second != first {
+		t.Errorf("Get after Close did not reuse the pooled encoder")
+	}
+	if _, err := w2.Write([]byte("world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w2.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	gr, err := gzip.NewReader(&buf2)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	got, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "world" {
+		t.Errorf("decompressed = %q, want %q", got, "world")
+	}
+}
+
+func TestCompressorGetUnknownEncoding(t *testing.T) {
+	pool := &Compressor{}
+	if _, err := pool.Get("unknown-encoding", noLevel, &bytes.Buffer{}); err == nil {
+		t.Error("Get with an unregistered encoding should return an error")
+	}
+}
+
+func TestCompressorGetSurfacesFactoryError(t *testing.T) {
+	RegisterEncoder("broken-for-test", 1, func(w io.Writer, level int) (io.WriteCloser, error) {
+		return nil, errors.New("boom")
+	})
+
+	_, err := (&Compressor{}).Get("broken-for-test", noLevel, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("Get should surface the factory's error instead of returning a nil WriteCloser")
+	}
+}
+
+func TestZstdEncoderAcceptsConventionalLevels(t *testing.T) {
+	entry, ok := lookupEncoder("zstd")
+	if !ok {
+		t.Fatal("zstd is not registered")
+	}
+
+	// These are conventional zstd levels (1-22), not zstd.EncoderLevel's own
+	// 1-4 enum; a caller configuring CompressOptions.Levels["zstd"] supplies
+	// values on this scale. None of them should make the factory fail.
+	for _, level := range []int{1, 3, 6, 19, 22} {
+		w, err := entry.factory(&bytes.Buffer{}, level)
+		if err != nil {
+			t.Errorf("zstd factory with level %d: %v", level, err)
+			continue
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("zstd factory with level %d: Close: %v", level, err)
+		}
+	}
+}
+
+func TestCompressWriterStreamingInterfaces(t *testing.T) {
+	rec := httptest.NewRecorder()
+	bodyLength := 0
+	cw := &compressWriter{
+		compress:   &DefaultCompress{},
+		rw:         rec,
+		encoding:   "gzip",
+		level:      noLevel,
+		pool:       &Compressor{},
+		bodyLength: &bodyLength,
+	}
+
+	cw.Header().Set(HeaderContentType, "text/plain")
+	bodyLength = 2048
+	cw.WriteHeader(200)
+
+	if got := cw.Header().Get(HeaderContentEncoding); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want %q", got, "gzip")
+	}
+
+	if _, err := cw.Write([]byte("streamed-chunk")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	cw.Flush() // must not panic, and must emit a gzip sync marker
+	if !bytes.HasSuffix(rec.Body.Bytes(), []byte{0x00, 0x00, 0xff, 0xff}) {
+		t.Fatal("Flush did not forward a sync marker to the underlying ResponseWriter")
+	}
+
+	if _, _, err := cw.Hijack(); err == nil {
+		t.Error("Hijack against an httptest.ResponseRecorder (no Hijacker support) should error")
+	}
+
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	gr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	got, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "streamed-chunk" {
+		t.Errorf("decompressed = %q, want %q", got, "streamed-chunk")
+	}
+}
+
+func TestCompressWriterSkipsAlreadyEncodedAndRangeResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   int
+		header map[string]string
+	}{
+		{"already encoded", 200, map[string]string{HeaderContentEncoding: "gzip"}},
+		{"partial content", 206, nil},
+		{"content-range", 200, map[string]string{HeaderContentRange: "bytes 0-99/200"}},
+		{"no-transform", 200, map[string]string{HeaderCacheControl: "no-transform"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			bodyLength := 2048
+			cw := &compressWriter{
+				compress:   &DefaultCompress{},
+				rw:         rec,
+				encoding:   "gzip",
+				level:      noLevel,
+				pool:       &Compressor{},
+				bodyLength: &bodyLength,
+			}
+			cw.Header().Set(HeaderContentType, "text/plain")
+			for k, v := range tt.header {
+				cw.Header().Set(k, v)
+			}
+			cw.WriteHeader(tt.code)
+
+			if cw.writer != nil {
+				t.Errorf("%s: compression was installed, want it skipped", tt.name)
+			}
+		})
+	}
+}